@@ -1,10 +1,19 @@
 package logrus_firehose
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/golang/snappy"
 	"github.com/sirupsen/logrus"
 )
 
@@ -23,6 +32,165 @@ type Option func(*FirehoseHook)
 */
 const firehoseMaxBatchSize = 500
 
+// firehoseMaxRecordBytes is the hard limit Firehose enforces on a single
+// record's payload size.
+const firehoseMaxRecordBytes = 1024000
+
+// defaultMaxBatchBytes is the soft cap applied to a batch's aggregate
+// payload size, left under Firehose's hard 4 MiB limit to leave headroom
+// for request framing.
+const defaultMaxBatchBytes = 3670016 // 3.5 MiB
+
+// oversizeMarker is appended to a record truncated because it exceeded
+// maxRecordBytes: a single entry when no OversizeHandler was configured,
+// or an aggregated record, which is truncated whether or not one is.
+var oversizeMarker = []byte("...[truncated: record exceeded max record bytes]")
+
+// Codec names the compression applied to an aggregated record.
+type Codec int
+
+const (
+	// CodecNone leaves the newline-joined aggregate uncompressed.
+	CodecNone Codec = iota
+	// CodecGzip gzip-compresses the aggregate.
+	CodecGzip
+	// CodecSnappy snappy-compresses the aggregate.
+	CodecSnappy
+)
+
+// gzipMagicHeader and snappyMagicHeader are prepended to a compressed
+// aggregate so downstream consumers (Lambda transforms, Athena) can
+// detect the codec before decompressing.
+var (
+	gzipMagicHeader   = []byte("FHGZ")
+	snappyMagicHeader = []byte("FHSZ")
+)
+
+// noAggregateField is the entry.Data field that, when set to bool true, opts
+// an entry out of aggregation so audit/critical events stay individually
+// addressable.
+const noAggregateField = "no_aggregate"
+
+// defaultAggregationMaxLines and defaultAggregationMaxBytes are used by
+// WithRecordAggregation when the caller leaves a field unset.
+const (
+	defaultAggregationMaxLines = 20
+	defaultAggregationMaxBytes = 800000
+)
+
+// AggregationConfig controls how multiple formatted entries are
+// concatenated into a single Firehose record to cut per-record and
+// per-GB ingestion cost.
+type AggregationConfig struct {
+	// MaxLines caps the number of entries joined into one record.
+	// Defaults to defaultAggregationMaxLines if zero.
+	MaxLines int
+
+	// MaxBytes caps the summed size of the formatted entries joined into
+	// one record, before compression; the newline separators are not
+	// counted, and a single entry larger than MaxBytes still forms a
+	// record on its own. Defaults to defaultAggregationMaxBytes if zero.
+	// Keep this comfortably under maxRecordBytes.
+	MaxBytes int
+
+	// Codec optionally compresses the aggregate before it is appended
+	// to the batch.
+	Codec Codec
+}
+
+// Counter is a monotonically increasing metric, e.g. records enqueued.
+type Counter interface {
+	Add(delta float64)
+}
+
+// Gauge is a metric that can go up or down, e.g. current queue depth.
+type Gauge interface {
+	Set(value float64)
+}
+
+// Histogram samples a distribution, e.g. batch send duration.
+type Histogram interface {
+	Observe(value float64)
+}
+
+// Metrics is implemented by a metrics backend capable of vending named
+// instruments. The core package stays free of a hard dependency on any
+// particular backend; see the prometheus sub-package for a concrete
+// implementation against prometheus.Registerer.
+type Metrics interface {
+	Counter(name string) Counter
+	Gauge(name string) Gauge
+	Histogram(name string) Histogram
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) Counter(string) Counter     { return noopInstrument{} }
+func (noopMetrics) Gauge(string) Gauge         { return noopInstrument{} }
+func (noopMetrics) Histogram(string) Histogram { return noopInstrument{} }
+
+type noopInstrument struct{}
+
+func (noopInstrument) Add(float64)     {}
+func (noopInstrument) Set(float64)     {}
+func (noopInstrument) Observe(float64) {}
+
+// retryableErrorCodes are the Firehose PutRecordBatch per-record ErrorCodes
+// that are expected to succeed on resubmission. Anything else (e.g. a
+// malformed record) is treated as permanent and dropped.
+var retryableErrorCodes = map[string]bool{
+	"ServiceUnavailableException": true,
+	"ThrottlingException":         true,
+	"InternalFailure":             true,
+}
+
+// DeadLetterFunc is invoked with records that exhausted all retry attempts
+// or that Firehose rejected with a permanent ErrorCode, along with an
+// error saying which, so callers can persist them to disk or a secondary
+// stream instead of losing them silently.
+type DeadLetterFunc func(records []*firehose.Record, err error)
+
+// RetryConfig controls the exponential backoff used to resubmit records
+// that Firehose reports as failed in a PutRecordBatch response.
+type RetryConfig struct {
+	// BaseDelay is the delay before the first retry attempt.
+	BaseDelay time.Duration
+
+	// MaxDelay caps the exponential backoff delay.
+	MaxDelay time.Duration
+
+	// MaxAttempts is the number of resubmission attempts before the
+	// records are handed to the dead-letter callback.
+	MaxAttempts int
+}
+
+// defaultRetryConfig is used when WithRetry is not specified.
+var defaultRetryConfig = RetryConfig{
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    30 * time.Second,
+	MaxAttempts: 3,
+}
+
+// ErrHookClosed is returned by Fire once Close has been called.
+var ErrHookClosed = errors.New("logrus_firehose: hook is closed")
+
+// defaultStreamNameField is the entry.Data field the default stream name
+// resolver reads from, unless overridden with WithStreamNameField.
+const defaultStreamNameField = "stream_name"
+
+// flushRequest asks a worker to emit its partially-filled batch, acking
+// on the channel once it has done so.
+type flushRequest struct {
+	ack chan struct{}
+}
+
+// firehoseClient is the subset of *firehose.Firehose used by FirehoseHook,
+// satisfied structurally so tests can substitute a fake without changing
+// the public constructor signatures.
+type firehoseClient interface {
+	PutRecordBatch(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error)
+}
+
 // FirehoseHook is logrus hook for AWS Firehose.
 // Amazon Kinesis Firehose is a fully-managed service that delivers real-time
 // streaming data to destinations such as Amazon Simple Storage Service (Amazon
@@ -32,12 +200,22 @@ type FirehoseHook struct {
 	/*
 		firehose client
 	*/
-	client *firehose.Firehose
+	client firehoseClient
+
+	/*
+		firehose stream name to write to when no resolver picks a different one
+	*/
+	defaultStreamName string
+
+	/*
+		entry.Data field read by the default stream name resolver
+	*/
+	streamNameField string
 
 	/*
-		firehose stream name to write to
+		resolves the stream name for an entry, if set
 	*/
-	streamName string
+	streamNameResolver func(*logrus.Entry) string
 
 	/*
 		levels being hooked
@@ -65,6 +243,40 @@ type FirehoseHook struct {
 	*/
 	sendBatchSize int
 
+	/*
+		max size in bytes of a single formatted record; records over this
+		are truncated or handed to oversizeHandler
+	*/
+	maxRecordBytes int
+
+	/*
+		soft cap in bytes on a batch's aggregate payload size
+	*/
+	maxBatchBytes int
+
+	/*
+		called instead of truncating a record that exceeds maxRecordBytes, if set
+	*/
+	oversizeHandler func(entry *logrus.Entry, data []byte)
+
+	/*
+		non-nil enables concatenating multiple entries into one record
+	*/
+	aggregation *AggregationConfig
+
+	/*
+		metrics backend; defaults to a no-op implementation
+	*/
+	metrics Metrics
+
+	recordsEnqueued Counter
+	recordsDropped  Counter
+	batchSize       Histogram
+	batchDuration   Histogram
+	failedPuts      Counter
+	retries         Counter
+	queueDepth      Gauge
+
 	/*
 		async queue used to
 	*/
@@ -80,24 +292,104 @@ type FirehoseHook struct {
 		nb of worker to send firehose event
 	*/
 	numWorker int
+
+	/*
+		retry behaviour applied to records Firehose reports as failed
+	*/
+	retryConfig RetryConfig
+
+	/*
+		called with records that exhausted all retry attempts, if set
+	*/
+	deadLetter DeadLetterFunc
+
+	/*
+		closed is set once Close has been called, rejecting further Fire calls
+	*/
+	closed int32
+
+	/*
+		closed by Close to signal workers to drain sendQueue and stop
+	*/
+	done chan struct{}
+	// closeOnce guards against Close being called more than once.
+	closeOnce sync.Once
+
+	// wg tracks running SendLoop workers so Close can wait for them.
+	wg sync.WaitGroup
+
+	// retryWg tracks in-flight background retry goroutines scheduled by
+	// scheduleRetry, so Close can wait for them instead of abandoning them.
+	retryWg sync.WaitGroup
+
+	// flushRequests, one per worker, used by Flush to force emission of
+	// a partially-filled batch without stopping the worker.
+	flushRequests []chan flushRequest
+}
+
+// Config holds the static AWS credentials used by New to build a Firehose
+// client. Leave it zero to fall back to the default credential chain
+// (environment, shared config, EC2/ECS role).
+type Config struct {
+	AccessKey string
+	SecretKey string
+	Region    string
+}
+
+// New returns an initialized FirehoseHook, building its own Firehose
+// client from conf and the default AWS credential chain. Use
+// NewWithAWSConfig or NewFirehoseHook directly to supply a
+// pre-configured client or session.
+func New(name string, conf Config, opts ...Option) (*FirehoseHook, error) {
+	awsConfig := aws.NewConfig()
+	if conf.Region != "" {
+		awsConfig = awsConfig.WithRegion(conf.Region)
+	}
+	if conf.AccessKey != "" && conf.SecretKey != "" {
+		awsConfig = awsConfig.WithCredentials(credentials.NewStaticCredentials(conf.AccessKey, conf.SecretKey, ""))
+	}
+	return NewWithAWSConfig(name, awsConfig, opts...)
+}
+
+// NewWithAWSConfig returns an initialized FirehoseHook using a Firehose
+// client built from a new session configured with config. A nil config
+// falls back to the default credential chain and region resolution.
+func NewWithAWSConfig(name string, config *aws.Config, opts ...Option) (*FirehoseHook, error) {
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+	return NewFirehoseHook(name, firehose.New(sess), opts...)
 }
 
 // NewFirehoseHook returns initialized logrus hook for Firehose with persistent Firehose logger.
-func NewFirehoseHook(name string, client *firehose.Firehose, opts ...Option) (*FirehoseHook, error) {
+func NewFirehoseHook(name string, client firehoseClient, opts ...Option) (*FirehoseHook, error) {
 	hk := &FirehoseHook{
-		client:           client,
-		streamName:       name,
-		levels:           DefaultLevels,
-		formatterFactory: func() logrus.Formatter { return &logrus.JSONFormatter{} },
-		sendBatchSize:    firehoseMaxBatchSize,
-		sendQueue:        make(chan *logrus.Entry, firehoseMaxBatchSize),
-		numWorker:        1,
-		blockingMode:     false,
-		addNewline:       false,
+		client:            client,
+		defaultStreamName: name,
+		levels:            DefaultLevels,
+		formatterFactory:  func() logrus.Formatter { return &logrus.JSONFormatter{} },
+		sendBatchSize:     firehoseMaxBatchSize,
+		maxRecordBytes:    firehoseMaxRecordBytes,
+		maxBatchBytes:     defaultMaxBatchBytes,
+		sendQueue:         make(chan *logrus.Entry, firehoseMaxBatchSize),
+		numWorker:         1,
+		blockingMode:      false,
+		addNewline:        false,
+		retryConfig:       defaultRetryConfig,
+		done:              make(chan struct{}),
+		metrics:           noopMetrics{},
 	}
 	for _, opt := range opts {
 		opt(hk)
 	}
+	hk.recordsEnqueued = hk.metrics.Counter("firehose_records_enqueued_total")
+	hk.recordsDropped = hk.metrics.Counter("firehose_records_dropped_total")
+	hk.batchSize = hk.metrics.Histogram("firehose_batch_size")
+	hk.batchDuration = hk.metrics.Histogram("firehose_batch_send_duration_seconds")
+	hk.failedPuts = hk.metrics.Counter("firehose_failed_put_total")
+	hk.retries = hk.metrics.Counter("firehose_retry_total")
+	hk.queueDepth = hk.metrics.Gauge("firehose_queue_depth")
 	return hk, nil
 }
 
@@ -146,6 +438,93 @@ func WithSendBatchSize(size int) Option {
 	}
 }
 
+// WithRetry enables exponential-backoff resubmission of records that
+// Firehose reports as failed in a PutRecordBatch response.
+func WithRetry(cfg RetryConfig) Option {
+	return func(hook *FirehoseHook) {
+		hook.retryConfig = cfg
+	}
+}
+
+// WithDeadLetter sets a callback invoked with records that exhausted all
+// retry attempts or failed with a permanent ErrorCode, so callers can
+// persist them instead of losing them.
+func WithDeadLetter(f DeadLetterFunc) Option {
+	return func(hook *FirehoseHook) {
+		hook.deadLetter = f
+	}
+}
+
+// WithStreamNameResolver sets a custom function to resolve the Firehose
+// delivery stream name for an entry, overriding the default resolver.
+// This lets a single logger fan out to multiple delivery streams, e.g.
+// per-tenant, per-severity, or per-service.
+func WithStreamNameResolver(f func(*logrus.Entry) string) Option {
+	return func(hook *FirehoseHook) {
+		hook.streamNameResolver = f
+	}
+}
+
+// WithStreamNameField sets the entry.Data field the default stream name
+// resolver reads from. It has no effect when WithStreamNameResolver is
+// used. Defaults to "stream_name".
+func WithStreamNameField(field string) Option {
+	return func(hook *FirehoseHook) {
+		hook.streamNameField = field
+	}
+}
+
+// WithMaxRecordBytes overrides the per-record byte limit, default
+// firehoseMaxRecordBytes. Only tune this for Firehose accounts on
+// non-default quotas.
+func WithMaxRecordBytes(n int) Option {
+	return func(hook *FirehoseHook) {
+		hook.maxRecordBytes = n
+	}
+}
+
+// WithMaxBatchBytes overrides the soft cap applied to a batch's
+// aggregate payload size, default defaultMaxBatchBytes.
+func WithMaxBatchBytes(n int) Option {
+	return func(hook *FirehoseHook) {
+		hook.maxBatchBytes = n
+	}
+}
+
+// WithOversizeHandler sets a callback invoked instead of truncating a
+// formatted record that exceeds maxRecordBytes, so callers can route
+// oversize entries elsewhere rather than losing their tail.
+func WithOversizeHandler(f func(entry *logrus.Entry, data []byte)) Option {
+	return func(hook *FirehoseHook) {
+		hook.oversizeHandler = f
+	}
+}
+
+// WithRecordAggregation enables concatenating up to cfg.MaxLines
+// formatted entries, separated by newlines, into a single Firehose
+// record, optionally compressed. Entries whose entry.Data["no_aggregate"]
+// field is the bool true are never aggregated.
+func WithRecordAggregation(cfg AggregationConfig) Option {
+	if cfg.MaxLines <= 0 {
+		cfg.MaxLines = defaultAggregationMaxLines
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = defaultAggregationMaxBytes
+	}
+	return func(hook *FirehoseHook) {
+		hook.aggregation = &cfg
+	}
+}
+
+// WithMetrics enables instrumentation of queue depth, drops, batch size
+// and send duration, and failed/retried puts against m. See the
+// prometheus sub-package for a ready-made backend.
+func WithMetrics(m Metrics) Option {
+	return func(hook *FirehoseHook) {
+		hook.metrics = m
+	}
+}
+
 var newLine = []byte("\n")
 
 /*
@@ -163,19 +542,105 @@ func (h *FirehoseHook) formatEntry(f logrus.Formatter, entry *logrus.Entry) []by
 	return bytes
 }
 
+// truncateRecord shortens data to fit within maxBytes, appending
+// oversizeMarker so the drop is visible downstream. If maxBytes is too
+// small to fit the marker, data is truncated without it.
+func truncateRecord(data []byte, maxBytes int) []byte {
+	if maxBytes <= len(oversizeMarker) {
+		return data[:maxBytes]
+	}
+	truncated := make([]byte, 0, maxBytes)
+	truncated = append(truncated, data[:maxBytes-len(oversizeMarker)]...)
+	truncated = append(truncated, oversizeMarker...)
+	return truncated
+}
+
+// entryOptsOutOfAggregation reports whether entry's noAggregateField is
+// the bool true, keeping it individually addressable.
+func entryOptsOutOfAggregation(entry *logrus.Entry) bool {
+	v, ok := entry.Data[noAggregateField]
+	if !ok {
+		return false
+	}
+	skip, ok := v.(bool)
+	return ok && skip
+}
+
+// compressAggregate compresses already newline-joined plaintext, if
+// codec is not CodecNone, behind its magic header so downstream
+// consumers can detect the codec before decompressing. Callers must
+// apply any size budget to plaintext themselves before calling this,
+// since compressing first and truncating the result after would slice
+// into the compressed stream and produce an undecodable record.
+func compressAggregate(plaintext []byte, codec Codec) []byte {
+	switch codec {
+	case CodecGzip:
+		return append(append([]byte{}, gzipMagicHeader...), gzipCompress(plaintext)...)
+	case CodecSnappy:
+		return append(append([]byte{}, snappyMagicHeader...), snappy.Encode(nil, plaintext)...)
+	default:
+		return plaintext
+	}
+}
+
+// gzipCompress gzip-compresses data, falling back to the uncompressed
+// input in the unexpected event that the in-memory writer errors.
+func gzipCompress(data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return data
+	}
+	if err := w.Close(); err != nil {
+		return data
+	}
+	return buf.Bytes()
+}
+
 // Levels returns logging level to fire this hook.
 func (h *FirehoseHook) Levels() []logrus.Level {
 	return h.levels
 }
 
+// SetLevels sets the logging levels that trigger this hook.
+func (h *FirehoseHook) SetLevels(levels []logrus.Level) {
+	h.levels = levels
+}
+
+// getStreamName resolves the Firehose delivery stream name for entry,
+// using h.streamNameResolver if set, falling back to the default
+// resolver which reads h.streamNameField (or "stream_name") off
+// entry.Data and falls back to h.defaultStreamName.
+func (h *FirehoseHook) getStreamName(entry *logrus.Entry) string {
+	if h.streamNameResolver != nil {
+		return h.streamNameResolver(entry)
+	}
+
+	field := h.streamNameField
+	if field == "" {
+		field = defaultStreamNameField
+	}
+	if v, ok := entry.Data[field]; ok {
+		if name, ok := v.(string); ok {
+			return name
+		}
+	}
+	return h.defaultStreamName
+}
+
 // Fire is invoked by logrus and sends log to Firehose.
 func (h *FirehoseHook) Fire(entry *logrus.Entry) error {
+	if atomic.LoadInt32(&h.closed) != 0 {
+		return ErrHookClosed
+	}
 	for {
 		select {
 		case h.sendQueue <- entry:
+			h.recordsEnqueued.Add(1)
 			return nil
 		default:
 			if !h.blockingMode {
+				h.recordsDropped.Add(1)
 				if h.logger != nil {
 					h.logger.Warn("queue is full and non-blocking mode specified, dropping record")
 				}
@@ -185,51 +650,335 @@ func (h *FirehoseHook) Fire(entry *logrus.Entry) error {
 	}
 }
 
+// SendLoop starts h.numWorker workers that batch entries off sendQueue
+// and PutRecordBatch them to Firehose, flushing early on every tick.
+// Call Close to stop the workers and drain sendQueue, or Flush to force
+// emission of a partially-filled batch without stopping them.
 func (h *FirehoseHook) SendLoop(tick <-chan time.Time) {
+	h.flushRequests = make([]chan flushRequest, h.numWorker)
+	h.wg.Add(h.numWorker)
 	for i := 0; i < h.numWorker; i++ {
-		go func() {
-			// do not share formatter cross workers
-			formatter := h.formatterFactory()
-			for {
-				buf := make([]*firehose.Record, 0, h.sendBatchSize)
-
-				select {
-				case <-tick:
-					break
-				case entry := <-h.sendQueue:
-					buf = append(buf, &firehose.Record{Data: h.formatEntry(formatter, entry)})
-					if len(buf) >= h.sendBatchSize {
-						break
-					}
-				default:
-					if len(buf) >= h.sendBatchSize {
-						break
-					}
-				}
-				if len(buf) == 0 {
-					continue
-				}
-				resp, err := h.client.PutRecordBatch(
-					&firehose.PutRecordBatchInput{
-						DeliveryStreamName: aws.String(h.streamName),
-						Records:            buf,
-					},
-				)
-				if err == nil && *resp.FailedPutCount == 0 {
-					if h.logger != nil {
-						h.logger.WithField("lines-emitted", len(resp.RequestResponses)).
-							Debug("log successfully emitted")
-					}
-					continue
-				}
-				if h.logger != nil {
-					h.logger.WithError(err).
-						WithField("failed-rec-count", *resp.FailedPutCount).
-						Warn("failed to send logs to firehose")
+		flushCh := make(chan flushRequest)
+		h.flushRequests[i] = flushCh
+		go h.worker(tick, flushCh)
+	}
+}
+
+func (h *FirehoseHook) worker(tick <-chan time.Time, flushCh chan flushRequest) {
+	defer h.wg.Done()
+	// do not share formatter cross workers
+	formatter := h.formatterFactory()
+	buf := make(map[string][]*firehose.Record)
+	bufBytes := make(map[string]int)
+	aggLines := make(map[string][][]byte)
+	aggBytes := make(map[string]int)
+
+	flushStream := func(streamName string) {
+		records := buf[streamName]
+		if len(records) == 0 {
+			return
+		}
+		h.sendBatch(streamName, records)
+		delete(buf, streamName)
+		delete(bufBytes, streamName)
+	}
+
+	// enqueue appends data, oversize-checked, as one record to
+	// streamName's batch, flushing the batch once it is full.
+	enqueue := func(streamName string, data []byte) {
+		if len(buf[streamName]) > 0 && bufBytes[streamName]+len(data) > h.maxBatchBytes {
+			flushStream(streamName)
+		}
+		buf[streamName] = append(buf[streamName], &firehose.Record{Data: data})
+		bufBytes[streamName] += len(data)
+		if len(buf[streamName]) >= h.sendBatchSize {
+			flushStream(streamName)
+		}
+	}
+
+	flushAggregate := func(streamName string) {
+		lines := aggLines[streamName]
+		if len(lines) == 0 {
+			return
+		}
+		plaintext := bytes.Join(lines, newLine)
+		if h.addNewline {
+			plaintext = append(plaintext, newLine...)
+		}
+		// Enforce the size budget on the plaintext, before compression:
+		// truncating a compressed stream after the fact would produce a
+		// record that advertises a codec header but can't be decoded.
+		if len(plaintext) > h.maxRecordBytes {
+			if h.logger != nil {
+				h.logger.WithField("stream-name", streamName).
+					Warn("truncating aggregated record exceeding max record bytes")
+			}
+			plaintext = truncateRecord(plaintext, h.maxRecordBytes)
+		}
+		data := compressAggregate(plaintext, h.aggregation.Codec)
+		if len(data) > h.maxRecordBytes {
+			// Pathological case: compression expanded an already
+			// size-bounded payload (e.g. incompressible input) past the
+			// limit. Hard-cut as a last resort so the batch can still be
+			// sent; this is the only path that can still produce an
+			// undecodable tail, and only when compression inflates data.
+			if h.logger != nil {
+				h.logger.WithField("stream-name", streamName).
+					Warn("compressed aggregate still exceeds max record bytes after truncation, hard-cutting")
+			}
+			data = data[:h.maxRecordBytes]
+		}
+		enqueue(streamName, data)
+		delete(aggLines, streamName)
+		delete(aggBytes, streamName)
+	}
+
+	flushAll := func() {
+		for streamName := range aggLines {
+			flushAggregate(streamName)
+		}
+		for streamName := range buf {
+			flushStream(streamName)
+		}
+	}
+
+	add := func(entry *logrus.Entry) {
+		streamName := h.getStreamName(entry)
+
+		if h.aggregation == nil || entryOptsOutOfAggregation(entry) {
+			data := h.formatEntry(formatter, entry)
+			if len(data) > h.maxRecordBytes {
+				if h.oversizeHandler != nil {
+					h.oversizeHandler(entry, data)
+					return
 				}
+				data = truncateRecord(data, h.maxRecordBytes)
 			}
-		}()
+			enqueue(streamName, data)
+			return
+		}
+
+		line, err := formatter.Format(entry)
+		if err != nil {
+			return
+		}
+		if len(line) > h.maxRecordBytes {
+			if h.oversizeHandler != nil {
+				h.oversizeHandler(entry, line)
+				return
+			}
+			line = truncateRecord(line, h.maxRecordBytes)
+		}
+		if len(aggLines[streamName]) > 0 && aggBytes[streamName]+len(line) > h.aggregation.MaxBytes {
+			flushAggregate(streamName)
+		}
+		aggLines[streamName] = append(aggLines[streamName], line)
+		aggBytes[streamName] += len(line)
+		if len(aggLines[streamName]) >= h.aggregation.MaxLines {
+			flushAggregate(streamName)
+		}
+	}
+
+	for {
+		select {
+		case <-h.done:
+			h.drainQueue(add)
+			flushAll()
+			return
+		case req := <-flushCh:
+			flushAll()
+			close(req.ack)
+		case <-tick:
+			h.queueDepth.Set(float64(len(h.sendQueue)))
+			flushAll()
+		case entry := <-h.sendQueue:
+			add(entry)
+		}
+	}
+}
+
+// drainQueue appends every entry remaining on sendQueue via add,
+// returning once the queue is empty.
+func (h *FirehoseHook) drainQueue(add func(*logrus.Entry)) {
+	for {
+		select {
+		case entry := <-h.sendQueue:
+			add(entry)
+		default:
+			return
+		}
+	}
+}
+
+// Flush forces emission of any partially-filled batch on every worker,
+// without stopping them. It blocks until all workers have acked or ctx
+// is done, whichever comes first.
+func (h *FirehoseHook) Flush(ctx context.Context) error {
+	for _, flushCh := range h.flushRequests {
+		req := flushRequest{ack: make(chan struct{})}
+		select {
+		case flushCh <- req:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case <-req.ack:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Close stops accepting new Fire calls, signals workers to drain
+// sendQueue into a final PutRecordBatch call, and waits for them and
+// any in-flight background retries to finish, bounded by ctx. It is
+// safe to call more than once.
+func (h *FirehoseHook) Close(ctx context.Context) error {
+	atomic.StoreInt32(&h.closed, 1)
+	h.closeOnce.Do(func() {
+		close(h.done)
+	})
+
+	doneWaiting := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		h.retryWg.Wait()
+		close(doneWaiting)
+	}()
+
+	select {
+	case <-doneWaiting:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sendBatch puts a batch of records to Firehose. It only ever makes the
+// first attempt inline; resubmission of records Firehose reports as
+// failed with a retryable ErrorCode is handed off to scheduleRetry so a
+// slow backoff can never stall the worker goroutine that calls this
+// (which would otherwise starve sendQueue and cause Fire to start
+// dropping records in non-blocking mode).
+func (h *FirehoseHook) sendBatch(streamName string, buf []*firehose.Record) {
+	h.batchSize.Observe(float64(len(buf)))
+	h.attemptSend(streamName, buf, 0)
+}
+
+// attemptSend makes one PutRecordBatch call for records, which is
+// attempt'th resubmission of the original batch (0 for the first try).
+// On a retryable failure it schedules a resubmission in the background
+// via scheduleRetry instead of blocking its caller.
+func (h *FirehoseHook) attemptSend(streamName string, records []*firehose.Record, attempt int) {
+	start := time.Now()
+	resp, err := h.client.PutRecordBatch(
+		&firehose.PutRecordBatchInput{
+			DeliveryStreamName: aws.String(streamName),
+			Records:            records,
+		},
+	)
+	h.batchDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		if h.logger != nil {
+			h.logger.WithError(err).Warn("failed to send logs to firehose")
+		}
+		if attempt >= h.retryConfig.MaxAttempts {
+			h.deadLetterRecords(records, err)
+			return
+		}
+		h.scheduleRetry(streamName, records, attempt)
+		return
+	}
+
+	if *resp.FailedPutCount == 0 {
+		if h.logger != nil {
+			h.logger.WithField("lines-emitted", len(resp.RequestResponses)).
+				Debug("log successfully emitted")
+		}
+		return
+	}
+	h.failedPuts.Add(float64(*resp.FailedPutCount))
+
+	retryable, permanent := partitionFailures(records, resp.RequestResponses)
+	if len(permanent) > 0 {
+		if h.logger != nil {
+			h.logger.WithField("dropped-rec-count", len(permanent)).
+				Warn("dropping records with permanent firehose errors")
+		}
+		h.deadLetterRecords(permanent, errors.New("firehose: permanent per-record error"))
+	}
+	if h.logger != nil {
+		h.logger.WithField("failed-rec-count", *resp.FailedPutCount).
+			WithField("retryable-rec-count", len(retryable)).
+			Warn("failed to send logs to firehose")
+	}
+	if len(retryable) == 0 {
+		return
+	}
+	if attempt >= h.retryConfig.MaxAttempts {
+		h.deadLetterRecords(retryable, errors.New("firehose: exhausted retry attempts"))
+		return
+	}
+
+	h.scheduleRetry(streamName, retryable, attempt)
+}
+
+// scheduleRetry resubmits records on their own goroutine after the
+// exponential backoff delay for attempt, tracked by h.retryWg so Close
+// can wait for in-flight retries instead of abandoning them.
+func (h *FirehoseHook) scheduleRetry(streamName string, records []*firehose.Record, attempt int) {
+	h.retries.Add(1)
+	delay := backoffDelay(h.retryConfig, attempt)
+	h.retryWg.Add(1)
+	go func() {
+		defer h.retryWg.Done()
+		time.Sleep(delay)
+		h.attemptSend(streamName, records, attempt+1)
+	}()
+}
+
+// backoffDelay returns the exponential backoff delay to wait before the
+// resubmission following the given (zero-indexed) failed attempt.
+func backoffDelay(cfg RetryConfig, attempt int) time.Duration {
+	delay := cfg.BaseDelay
+	for i := 0; i < attempt; i++ {
+		delay = nextBackoff(delay, cfg.MaxDelay)
+	}
+	return delay
+}
+
+// partitionFailures splits records into those worth resubmitting and
+// those with a permanent ErrorCode, based on the per-record responses
+// returned alongside a PutRecordBatch call for the same records slice.
+func partitionFailures(records []*firehose.Record, responses []*firehose.PutRecordBatchResponseEntry) (retryable, permanent []*firehose.Record) {
+	for i, res := range responses {
+		if res.ErrorCode == nil {
+			continue
+		}
+		if retryableErrorCodes[*res.ErrorCode] {
+			retryable = append(retryable, records[i])
+		} else {
+			permanent = append(permanent, records[i])
+		}
+	}
+	return retryable, permanent
+}
+
+// nextBackoff doubles delay, capped at max.
+func nextBackoff(delay, max time.Duration) time.Duration {
+	delay *= 2
+	if delay > max {
+		return max
+	}
+	return delay
+}
+
+func (h *FirehoseHook) deadLetterRecords(records []*firehose.Record, err error) {
+	if len(records) == 0 || h.deadLetter == nil {
+		return
 	}
+	h.deadLetter(records, err)
 }
 
 var _ logrus.Hook = (*FirehoseHook)(nil)
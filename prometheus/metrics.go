@@ -0,0 +1,74 @@
+// Package prometheus implements logrus_firehose.Metrics against a
+// prometheus.Registerer, keeping the core package free of a hard
+// dependency on the Prometheus client.
+package prometheus
+
+import (
+	"sync"
+
+	firehose "github.com/beaubrewer/logrus_firehose"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics vends and registers counters, gauges and histograms on first
+// use, one per distinct name.
+type Metrics struct {
+	reg prometheus.Registerer
+
+	mu         sync.Mutex
+	counters   map[string]prometheus.Counter
+	gauges     map[string]prometheus.Gauge
+	histograms map[string]prometheus.Histogram
+}
+
+// New returns a Metrics that registers its instruments on reg.
+func New(reg prometheus.Registerer) *Metrics {
+	return &Metrics{
+		reg:        reg,
+		counters:   make(map[string]prometheus.Counter),
+		gauges:     make(map[string]prometheus.Gauge),
+		histograms: make(map[string]prometheus.Histogram),
+	}
+}
+
+// Counter returns the named counter, registering it on first use.
+func (m *Metrics) Counter(name string) firehose.Counter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.counters[name]; ok {
+		return c
+	}
+	c := prometheus.NewCounter(prometheus.CounterOpts{Name: name, Help: name})
+	m.reg.MustRegister(c)
+	m.counters[name] = c
+	return c
+}
+
+// Gauge returns the named gauge, registering it on first use.
+func (m *Metrics) Gauge(name string) firehose.Gauge {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if g, ok := m.gauges[name]; ok {
+		return g
+	}
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: name, Help: name})
+	m.reg.MustRegister(g)
+	m.gauges[name] = g
+	return g
+}
+
+// Histogram returns the named histogram, registering it on first use
+// with the client's default buckets.
+func (m *Metrics) Histogram(name string) firehose.Histogram {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if h, ok := m.histograms[name]; ok {
+		return h
+	}
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{Name: name, Help: name})
+	m.reg.MustRegister(h)
+	m.histograms[name] = h
+	return h
+}
+
+var _ firehose.Metrics = (*Metrics)(nil)